@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+// runTokenSecret signs run tokens so a client can't subscribe to a run it
+// was never handed the id for by guessing runIDs on /ws. Override with
+// RUN_TOKEN_SECRET in any environment that isn't local dev.
+var runTokenSecret = []byte(envOrDefault("RUN_TOKEN_SECRET", "dev-only-insecure-secret"))
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// signRunToken returns an opaque "<base64 runID>.<hex HMAC>" token for
+// runID, handed back from POST /api/run and required as the `token` query
+// param on /ws.
+func signRunToken(runID string) string {
+	encodedID := base64.RawURLEncoding.EncodeToString([]byte(runID))
+	return encodedID + "." + hexHMAC(encodedID)
+}
+
+// verifyRunToken checks a token's HMAC and, if valid, returns the runID it
+// was signed for.
+func verifyRunToken(token string) (string, error) {
+	encodedID, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errors.New("malformed run token")
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(hexHMAC(encodedID))) {
+		return "", errors.New("invalid run token signature")
+	}
+
+	runID, err := base64.RawURLEncoding.DecodeString(encodedID)
+	if err != nil {
+		return "", errors.New("invalid run token")
+	}
+	return string(runID), nil
+}
+
+func hexHMAC(data string) string {
+	mac := hmac.New(sha256.New, runTokenSecret)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSignRunTokenRoundTrip(t *testing.T) {
+	token := signRunToken("run-123")
+
+	runID, err := verifyRunToken(token)
+	if err != nil {
+		t.Fatalf("verifyRunToken returned error for a token we just signed: %v", err)
+	}
+	if runID != "run-123" {
+		t.Fatalf("verifyRunToken = %q, want %q", runID, "run-123")
+	}
+}
+
+func TestVerifyRunTokenRejectsTampering(t *testing.T) {
+	token := signRunToken("run-123")
+
+	if _, err := verifyRunToken(token + "x"); err == nil {
+		t.Fatal("expected error for a tampered signature, got nil")
+	}
+}
+
+func TestVerifyRunTokenRejectsForgedRunID(t *testing.T) {
+	forged := signRunToken("run-a")
+	other := signRunToken("run-b")
+
+	idPart, _, ok := strings.Cut(forged, ".")
+	if !ok {
+		t.Fatalf("could not split token %q", forged)
+	}
+	_, sig, ok := strings.Cut(other, ".")
+	if !ok {
+		t.Fatalf("could not split token %q", other)
+	}
+	stitched := idPart + "." + sig
+
+	if _, err := verifyRunToken(stitched); err == nil {
+		t.Fatal("expected error when run id and signature come from different tokens")
+	}
+}
+
+func TestVerifyRunTokenRejectsMalformed(t *testing.T) {
+	if _, err := verifyRunToken("not-a-valid-token"); err == nil {
+		t.Fatal("expected error for a malformed token, got nil")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	jsonRPCVersion = "2.0"
+
+	// wsSubprotocol is negotiated via the Sec-WebSocket-Protocol header so
+	// clients can rely on an off-the-shelf JSON-RPC library instead of
+	// hand-rolling the {"type":...,"data":...} scheme this replaces.
+	wsSubprotocol = "sebrauc.v1+jsonrpc"
+
+	jsonRPCMethodNotFound = -32601
+	jsonRPCInternalError  = -32000
+)
+
+// jsonRPCRequest is an inbound call. ID is nil for notifications, which
+// get no response even if their handler errors.
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      interface{}     `json:"id,omitempty"`
+}
+
+// jsonRPCResponse is the {jsonrpc,id,result|error} reply to a request that
+// carried an id.
+type jsonRPCResponse struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      interface{}   `json:"id"`
+	Result  interface{}   `json:"result,omitempty"`
+	Error   *jsonRPCError `json:"error,omitempty"`
+}
+
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// jsonRPCNotification is an outbound, unsolicited message such as
+// trace.frame or trace.end — no id, no response expected.
+type jsonRPCNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcHandler handles one inbound method call and returns its result, or an
+// error that gets translated into a JSON-RPC error response.
+type rpcHandler func(params json.RawMessage) (result interface{}, err error)
+
+// Dispatcher routes inbound JSON-RPC requests on a WebSocket connection to
+// registered method handlers, and serializes outbound notifications, so
+// streamRun and the connection's method handlers never touch the raw
+// connection directly.
+type Dispatcher struct {
+	conn     *websocketConnection
+	handlers map[string]rpcHandler
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// newDispatcher builds a Dispatcher whose Context is canceled as soon as
+// either parent is canceled (e.g. server shutdown) or the connection's read
+// loop exits (e.g. the client disconnected), whichever happens first.
+func newDispatcher(conn *websocketConnection, parent context.Context) *Dispatcher {
+	ctx, cancel := context.WithCancel(parent)
+	return &Dispatcher{conn: conn, handlers: make(map[string]rpcHandler), ctx: ctx, cancel: cancel}
+}
+
+// Context is canceled once the connection is done, one way or another, so
+// long-running work like streamRun can stop promptly instead of blocking
+// on a send to a dead socket or waiting out its current frame delay.
+func (d *Dispatcher) Context() context.Context {
+	return d.ctx
+}
+
+// handle registers the handler invoked for inbound requests/notifications
+// with the given method name.
+func (d *Dispatcher) handle(method string, handler rpcHandler) {
+	d.handlers[method] = handler
+}
+
+// Notify sends an unsolicited notification, e.g. Notify("trace.frame", traceFrameParams{...}).
+func (d *Dispatcher) Notify(method string, params interface{}) error {
+	return d.conn.WriteJSON(jsonRPCNotification{
+		JSONRPC: jsonRPCVersion,
+		Method:  method,
+		Params:  params,
+	})
+}
+
+// Serve reads inbound requests until the connection closes or errors,
+// dispatching each to its registered handler. It's meant to run in its own
+// goroutine alongside streamRun's notifications on the same connection.
+// Canceling d.Context()'s parent (server shutdown) closes the connection to
+// unblock the read and stop Serve promptly.
+func (d *Dispatcher) Serve() {
+	defer d.cancel()
+
+	go func() {
+		<-d.ctx.Done()
+		d.conn.Close()
+	}()
+
+	for {
+		var req jsonRPCRequest
+		if err := d.conn.ReadJSON(&req); err != nil {
+			return
+		}
+		d.dispatch(req)
+	}
+}
+
+func (d *Dispatcher) dispatch(req jsonRPCRequest) {
+	handler, ok := d.handlers[req.Method]
+	if !ok {
+		if req.ID != nil {
+			d.respondError(req.ID, jsonRPCMethodNotFound, fmt.Sprintf("method not found: %s", req.Method))
+		}
+		return
+	}
+
+	result, err := handler(req.Params)
+	if req.ID == nil {
+		return // notification: no response expected, even on error
+	}
+	if err != nil {
+		d.respondError(req.ID, jsonRPCInternalError, err.Error())
+		return
+	}
+	d.conn.WriteJSON(jsonRPCResponse{JSONRPC: jsonRPCVersion, ID: req.ID, Result: result})
+}
+
+func (d *Dispatcher) respondError(id interface{}, code int, message string) {
+	d.conn.WriteJSON(jsonRPCResponse{
+		JSONRPC: jsonRPCVersion,
+		ID:      id,
+		Error:   &jsonRPCError{Code: code, Message: message},
+	})
+}
@@ -1,139 +1,290 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	wsmw "github.com/gofiber/websocket/v2"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for development
-	},
-}
+const (
+	// pongWait is how long we'll wait for a pong before considering the
+	// client gone; pingPeriod must stay comfortably under it.
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+
+	// shutdownDrainTimeout bounds how long we wait for active WebSocket
+	// streams to wind down on their own before forcing the process to exit.
+	shutdownDrainTimeout = 10 * time.Second
+)
 
+// serverCtx is canceled on SIGINT/SIGTERM; every streamRun derives its
+// per-connection context from it, so shutdown cancels every in-flight run
+// without each one having to poll a separate signal channel.
+var (
+	serverCtx, cancelServer = context.WithCancel(context.Background())
+	activeConns             sync.WaitGroup
+)
+
+// websocketConnection wraps *websocket.Conn with a write mutex, since the
+// frame-streaming loop and the keepalive ping ticker write concurrently and
+// gorilla's Conn does not support that on its own.
 type websocketConnection struct {
 	*websocket.Conn
+	writeMu sync.Mutex
 }
 
 func (c *websocketConnection) WriteJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	return c.Conn.WriteJSON(v)
 }
 
-// Enable CORS
-func enableCORS(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+func (c *websocketConnection) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteControl(messageType, data, deadline)
 }
 
-// POST /api/run - Create a new run
-func handleRunCreate(w http.ResponseWriter, r *http.Request) {
-	enableCORS(w)
-
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
+// POST /api/run - Create a new run, returning its id and a signed token
+// required to open /ws for it.
+func handleRunCreate(c *fiber.Ctx) error {
 	var request struct {
 		AlgorithmID string `json:"algorithmId"`
 		Array       []int  `json:"array"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	if err := c.BodyParser(&request); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 	}
 
-	// Validate input
 	if len(request.Array) == 0 {
-		http.Error(w, "Array cannot be empty", http.StatusBadRequest)
-		return
+		return fiber.NewError(fiber.StatusBadRequest, "Array cannot be empty")
 	}
 
-	// Create run
-	run, err := createRun(request.AlgorithmID, request.Array)
+	run, err := createRun(c.Context(), request.AlgorithmID, request.Array)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create run: %v", err), http.StatusInternalServerError)
-		return
+		return fiber.NewError(fiber.StatusInternalServerError, fmt.Sprintf("Failed to create run: %v", err))
 	}
 
-	// Return runId
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	return c.JSON(fiber.Map{
 		"runId": run.RunID,
+		"token": signRunToken(run.RunID),
 	})
 }
 
-// GET /ws?runId=<id> - WebSocket handler
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	runID := r.URL.Query().Get("runId")
-	if runID == "" {
-		http.Error(w, "Missing runId parameter", http.StatusBadRequest)
-		return
+// requireRunToken verifies the signed `token` query param and that it was
+// issued for the run in the URL, so guessing/observing a runID alone isn't
+// enough to read or delete another client's run over plain HTTP.
+func requireRunToken(c *fiber.Ctx) error {
+	token := c.Query("token")
+	if token == "" {
+		return fiber.NewError(fiber.StatusUnauthorized, "missing token parameter")
 	}
 
-	speedStr := r.URL.Query().Get("speed")
-	speedMultiplier := 1.0
-	if speedStr != "" {
-		fmt.Sscanf(speedStr, "%f", &speedMultiplier)
+	runID, err := verifyRunToken(token)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+	}
+	if runID != c.Params("id") {
+		return fiber.NewError(fiber.StatusUnauthorized, "token does not match run id")
 	}
+	return c.Next()
+}
 
-	// Upgrade connection
-	conn, err := upgrader.Upgrade(w, r, nil)
+// GET /api/run/:id - Fetch a run's stored state, so a client can resume it
+// after a disconnect or reload.
+func handleRunGet(c *fiber.Ctx) error {
+	run, exists, err := runStore.Get(c.Params("id"))
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
-		return
+		return fiber.NewError(fiber.StatusInternalServerError, fmt.Sprintf("Failed to load run: %v", err))
+	}
+	if !exists {
+		return fiber.NewError(fiber.StatusNotFound, "Run not found")
 	}
+	return c.JSON(run)
+}
+
+// DELETE /api/run/:id - Remove a run's stored state.
+func handleRunDelete(c *fiber.Ctx) error {
+	if err := runStore.Delete(c.Params("id")); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, fmt.Sprintf("Failed to delete run: %v", err))
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// wsAuthAndLimit verifies the signed `token` query param and reserves a
+// concurrent-connection slot for the caller's IP before the WebSocket
+// upgrade happens, so guessed/unauthorized runIDs and connection floods
+// are both rejected up front.
+func wsAuthAndLimit(c *fiber.Ctx) error {
+	if !wsmw.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	token := c.Query("token")
+	if token == "" {
+		return fiber.NewError(fiber.StatusUnauthorized, "missing token parameter")
+	}
+	runID, err := verifyRunToken(token)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+	}
+
+	ip := c.IP()
+	if !wsLimiter.acquire(ip) {
+		return fiber.NewError(fiber.StatusTooManyRequests, "too many concurrent connections from this IP")
+	}
+
+	c.Locals("runId", runID)
+	c.Locals("wsIP", ip)
+	c.Locals("speed", c.Query("speed"))
+	return c.Next()
+}
+
+// GET /ws?token=<token> - WebSocket handler. Serves a JSON-RPC 2.0
+// Dispatcher over the connection: trace.frame/trace.explanation/trace.end/
+// trace.error notifications out, run.pause/run.resume/run.step/run.seek/
+// run.setSpeed/run.replay/behavior.report method calls in (see
+// rpc_methods.go). runId/IP/speed are threaded through from wsAuthAndLimit
+// via fiber locals. The stream's context is a child of serverCtx, so a
+// client disconnect (connection closes, Dispatcher.Serve's read errors)
+// and a server shutdown (serverCtx canceled) both stop it the same way.
+func handleWebSocket(conn *wsmw.Conn) {
+	activeConns.Add(1)
+	defer activeConns.Done()
+
+	runID, _ := conn.Locals("runId").(string)
+	ip, _ := conn.Locals("wsIP").(string)
+	defer wsLimiter.release(ip)
 	defer conn.Close()
 
-	wsConn := &websocketConnection{Conn: conn}
+	speedMultiplier := 1.0
+	if speedStr, _ := conn.Locals("speed").(string); speedStr != "" {
+		fmt.Sscanf(speedStr, "%f", &speedMultiplier)
+	}
+
+	wsConn := &websocketConnection{Conn: conn.Conn}
+
+	conn.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.Conn.SetPongHandler(func(string) error {
+		conn.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	control := newStreamControl(speedMultiplier)
+	dispatcher := newDispatcher(wsConn, serverCtx)
+	registerControlHandlers(dispatcher, runID, control)
+	go dispatcher.Serve()
+
+	done := make(chan struct{})
+	defer close(done)
+	go sendKeepalivePings(wsConn, done)
 
 	// Stream the run
-	if err := streamRun(runID, wsConn, speedMultiplier); err != nil {
+	if err := streamRun(dispatcher.Context(), runID, dispatcher, control); err != nil {
 		log.Printf("Error streaming run: %v", err)
-		// Try to send error message
-		wsConn.WriteJSON(map[string]interface{}{
-			"type": "ERROR",
-			"data": map[string]string{
-				"message": err.Error(),
-			},
-		})
+		dispatcher.Notify("trace.error", traceErrorParams{Message: err.Error()})
+	}
+}
+
+// sendKeepalivePings pings the client every pingPeriod so idle connections
+// get cleaned up instead of stalling the run indefinitely; it stops as soon
+// as done is closed or a write fails.
+func sendKeepalivePings(conn *websocketConnection, done <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
 	}
 }
 
 // GET /health - Health check
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	enableCORS(w)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+func handleHealth(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
 		"status":  "healthy",
 		"service": "go-backend",
 	})
 }
 
 func main() {
-	http.HandleFunc("/api/run", handleRunCreate)
-	http.HandleFunc("/ws", handleWebSocket)
-	http.HandleFunc("/health", handleHealth)
+	if dbPath := os.Getenv("RUN_STORE_PATH"); dbPath != "" {
+		store, err := newSQLiteRunStore(dbPath, 5*time.Minute, 24*time.Hour)
+		if err != nil {
+			log.Fatalf("failed to initialize sqlite run store: %v", err)
+		}
+		runStore = store
+		fmt.Printf("💾 Using SQLite run store at %s\n", dbPath)
+	}
+
+	app := fiber.New()
+	app.Use(recover.New())
+	app.Use(cors.New(cors.Config{
+		AllowOrigins: "*",
+		AllowMethods: "GET,POST,DELETE,OPTIONS",
+		AllowHeaders: "Content-Type",
+	}))
+	app.Use(compress.New())
+
+	app.Post("/api/run", handleRunCreate)
+	app.Get("/api/run/:id", requireRunToken, handleRunGet)
+	app.Delete("/api/run/:id", requireRunToken, handleRunDelete)
+	app.Get("/ws", wsAuthAndLimit, wsmw.New(handleWebSocket, wsmw.Config{
+		Subprotocols: []string{wsSubprotocol},
+	}))
+	app.Get("/health", handleHealth)
 
 	port := ":8080"
-	fmt.Printf("ðŸš€ Go backend starting on port %s\n", port)
-	fmt.Println("ðŸ“¡ WebSocket endpoint: ws://localhost:8080/ws?runId=<id>")
-	fmt.Println("ðŸ”— API endpoint: http://localhost:8080/api/run")
+	fmt.Printf("🚀 Go backend starting on port %s\n", port)
+	fmt.Println("📡 WebSocket endpoint: ws://localhost:8080/ws?token=<token>")
+	fmt.Println("🔗 API endpoint: http://localhost:8080/api/run")
+
+	go func() {
+		if err := app.Listen(port); err != nil {
+			log.Printf("server stopped: %v", err)
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	fmt.Println("🛑 Shutting down, draining active WebSocket streams...")
+	cancelServer()
+
+	if err := app.ShutdownWithTimeout(shutdownDrainTimeout); err != nil {
+		log.Printf("error during server shutdown: %v", err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		activeConns.Wait()
+		close(drained)
+	}()
 
-	if err := http.ListenAndServe(port, nil); err != nil {
-		log.Fatal(err)
+	select {
+	case <-drained:
+		fmt.Println("✅ All connections drained")
+	case <-time.After(shutdownDrainTimeout):
+		fmt.Println("⏱️ Shutdown timeout reached, forcing exit")
 	}
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// pythonStreamURL is the persistent, bidirectional explain endpoint on
+	// the Python side, as opposed to the one-shot pythonBaseURL+"/explain-step".
+	pythonStreamURL = "ws://localhost:8000/explain-stream"
+
+	// pythonPoolSize caps how many persistent connections to the Python
+	// explainer we keep warm at once.
+	pythonPoolSize = 4
+
+	// lookaheadFrames is how many upcoming frames streamRun pipelines into
+	// the explainer ahead of the one currently on screen, so the next
+	// explanation is usually already in hand by the time it's needed.
+	lookaheadFrames = 3
+)
+
+// explainFrameRequest is one frame in a batched explain request.
+type explainFrameRequest struct {
+	Step         int                    `json:"step"`
+	Frame        map[string]interface{} `json:"frame"`
+	UserBehavior map[string]interface{} `json:"userBehavior"`
+}
+
+type explainBatchRequest struct {
+	RunID  string                `json:"runId"`
+	Frames []explainFrameRequest `json:"frames"`
+}
+
+type explainBatchResponse struct {
+	Explanations map[int]map[string]interface{} `json:"explanations"`
+}
+
+// PythonClient holds a small pool of persistent WebSocket connections to
+// the Python explainer and pipelines batched explain requests over them
+// instead of opening a new HTTP connection per frame. ExplainBatch falls
+// back to the existing one-shot HTTP /explain-step endpoint, one frame at
+// a time, whenever the stream can't be established or breaks mid-batch.
+type PythonClient struct {
+	pool chan *websocket.Conn
+}
+
+func newPythonClient(poolSize int) *PythonClient {
+	return &PythonClient{pool: make(chan *websocket.Conn, poolSize)}
+}
+
+var defaultPythonClient = newPythonClient(pythonPoolSize)
+
+// acquire returns a pooled connection if one is idle, otherwise dials a
+// fresh one. This is a minimal pool (no warm-up, no health check beyond
+// "did the last call fail") rather than a general-purpose one.
+func (c *PythonClient) acquire(ctx context.Context) (*websocket.Conn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, pythonStreamURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial python explain stream: %w", err)
+	}
+	return conn, nil
+}
+
+func (c *PythonClient) release(conn *websocket.Conn) {
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// ExplainBatch requests explanations for several frames in a single round
+// trip over a pooled persistent connection, so the caller can pre-fetch
+// upcoming steps while the current one is displayed. It falls back to the
+// per-frame HTTP endpoint if the stream is unavailable.
+func (c *PythonClient) ExplainBatch(ctx context.Context, runID string, frames []explainFrameRequest) (map[int]map[string]interface{}, error) {
+	explanations, err := c.explainBatchStreamed(ctx, runID, frames)
+	if err == nil {
+		return explanations, nil
+	}
+
+	fmt.Printf("Explain stream unavailable, falling back to HTTP: %v\n", err)
+	return c.explainBatchHTTP(ctx, frames)
+}
+
+func (c *PythonClient) explainBatchStreamed(ctx context.Context, runID string, frames []explainFrameRequest) (map[int]map[string]interface{}, error) {
+	conn, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// gorilla's WriteJSON/ReadJSON don't take a context, so a client
+	// disconnect or server shutdown wouldn't otherwise unblock a call stuck
+	// waiting on a slow/hung Python side. Watch ctx alongside the call and
+	// close the connection out from under it to force the unblock. stopWatch
+	// blocks until the watcher goroutine has actually exited, so it's safe to
+	// call right before release(conn) below: without that wait, a
+	// cancellation landing between a successful ReadJSON and release could
+	// have the watcher close the connection just as it's handed back to the
+	// pool, and a future acquire() caller would get an already-closed socket.
+	watchDone := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	stopWatch := func() {
+		close(stop)
+		<-watchDone
+	}
+
+	req := explainBatchRequest{RunID: runID, Frames: frames}
+	if err := conn.WriteJSON(req); err != nil {
+		stopWatch()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to send batch explain request: %w", err)
+	}
+
+	var resp explainBatchResponse
+	if err := conn.ReadJSON(&resp); err != nil {
+		stopWatch()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to read batch explain response: %w", err)
+	}
+
+	stopWatch()
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	c.release(conn)
+	return resp.Explanations, nil
+}
+
+func (c *PythonClient) explainBatchHTTP(ctx context.Context, frames []explainFrameRequest) (map[int]map[string]interface{}, error) {
+	explanations := make(map[int]map[string]interface{}, len(frames))
+	for _, f := range frames {
+		explanation, err := callPythonExplain(ctx, f.Frame, f.UserBehavior)
+		if err != nil {
+			return nil, fmt.Errorf("fallback HTTP explain failed for step %d: %w", f.Step, err)
+		}
+		explanations[f.Step] = explanation
+	}
+	return explanations, nil
+}
+
+// explanationCache holds pre-fetched explanations, keyed by step, that
+// streamRun drains as it reaches each frame.
+type explanationCache struct {
+	mu      sync.Mutex
+	entries map[int]map[string]interface{}
+}
+
+func newExplanationCache() *explanationCache {
+	return &explanationCache{entries: make(map[int]map[string]interface{})}
+}
+
+func (c *explanationCache) take(step int) (map[string]interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	explanation, ok := c.entries[step]
+	if ok {
+		delete(c.entries, step)
+	}
+	return explanation, ok
+}
+
+func (c *explanationCache) has(step int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[step]
+	return ok
+}
+
+func (c *explanationCache) put(step int, explanation map[string]interface{}) {
+	c.mu.Lock()
+	c.entries[step] = explanation
+	c.mu.Unlock()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Outbound notification params.
+
+type traceFrameParams struct {
+	Frame map[string]interface{} `json:"frame"`
+}
+
+type traceExplanationParams struct {
+	Explanation map[string]interface{} `json:"explanation"`
+}
+
+type traceEndParams struct {
+	Message string `json:"message"`
+}
+
+type traceErrorParams struct {
+	Message string `json:"message"`
+}
+
+// Inbound method call params.
+
+type runSeekParams struct {
+	Step int `json:"step"`
+}
+
+type runSetSpeedParams struct {
+	Speed float64 `json:"speed"`
+}
+
+type behaviorReportParams struct {
+	Step        int  `json:"step"`
+	HoverIndex  *int `json:"hoverIndex,omitempty"`
+	ScrollDepth *int `json:"scrollDepth,omitempty"`
+}
+
+// registerControlHandlers wires the run.* and behavior.* JSON-RPC methods
+// a client can call on a run's WebSocket to the run's streamControl.
+func registerControlHandlers(d *Dispatcher, runID string, control *streamControl) {
+	d.handle("run.pause", func(json.RawMessage) (interface{}, error) {
+		control.setPaused(true)
+		return map[string]bool{"paused": true}, nil
+	})
+
+	d.handle("run.resume", func(json.RawMessage) (interface{}, error) {
+		control.setPaused(false)
+		return map[string]bool{"paused": false}, nil
+	})
+
+	d.handle("run.step", func(json.RawMessage) (interface{}, error) {
+		control.setPaused(true)
+		control.seek(currentRunStep(runID) + 1)
+		return map[string]bool{"stepped": true}, nil
+	})
+
+	d.handle("run.seek", func(raw json.RawMessage) (interface{}, error) {
+		var params runSeekParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, fmt.Errorf("invalid run.seek params: %w", err)
+		}
+		control.seek(params.Step)
+		return map[string]int{"step": params.Step}, nil
+	})
+
+	d.handle("run.setSpeed", func(raw json.RawMessage) (interface{}, error) {
+		var params runSetSpeedParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, fmt.Errorf("invalid run.setSpeed params: %w", err)
+		}
+		control.setSpeed(params.Speed)
+		return map[string]float64{"speed": params.Speed}, nil
+	})
+
+	d.handle("run.replay", func(json.RawMessage) (interface{}, error) {
+		control.requestReplay()
+		return map[string]bool{"replaying": true}, nil
+	})
+
+	d.handle("behavior.report", func(raw json.RawMessage) (interface{}, error) {
+		var params behaviorReportParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, fmt.Errorf("invalid behavior.report params: %w", err)
+		}
+		if err := recordHoverAndScroll(runID, params); err != nil {
+			return nil, fmt.Errorf("failed to record behavior: %w", err)
+		}
+		return map[string]bool{"recorded": true}, nil
+	})
+}
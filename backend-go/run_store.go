@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RunStore persists RunState and BehaviorSignal data for active and
+// historical runs. createRun, getBehaviorSignal and streamRun all go
+// through it instead of touching storage directly, so the backing driver
+// can be swapped (e.g. in-memory for a single dev instance, SQLite for
+// something that survives a restart) without changing any of them.
+type RunStore interface {
+	Create(run *RunState) error
+	Get(runID string) (run *RunState, exists bool, err error)
+	UpdateCurrentStep(runID string, step int) error
+	UpdateBehavior(runID string, step int, mutate func(signal *BehaviorSignal)) error
+	List() ([]*RunState, error)
+	Delete(runID string) error
+	Expire(olderThan time.Duration) (removed int, err error)
+}
+
+// inMemoryRunStore is the original map-backed store: fast, but every
+// restart drops all runs and it can't be shared across instances.
+type inMemoryRunStore struct {
+	mu        sync.RWMutex
+	runs      map[string]*RunState
+	createdAt map[string]time.Time
+}
+
+func newInMemoryRunStore() *inMemoryRunStore {
+	return &inMemoryRunStore{
+		runs:      make(map[string]*RunState),
+		createdAt: make(map[string]time.Time),
+	}
+}
+
+func (s *inMemoryRunStore) Create(run *RunState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[run.RunID] = run
+	s.createdAt[run.RunID] = time.Now()
+	return nil
+}
+
+func (s *inMemoryRunStore) Get(runID string) (*RunState, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	run, exists := s.runs[runID]
+	return run, exists, nil
+}
+
+func (s *inMemoryRunStore) UpdateCurrentStep(runID string, step int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, exists := s.runs[runID]
+	if !exists {
+		return fmt.Errorf("run not found: %s", runID)
+	}
+	run.CurrentStep = step
+	return nil
+}
+
+func (s *inMemoryRunStore) UpdateBehavior(runID string, step int, mutate func(signal *BehaviorSignal)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, exists := s.runs[runID]
+	if !exists {
+		return fmt.Errorf("run not found: %s", runID)
+	}
+	signal, ok := run.BehaviorSignals[step]
+	if !ok {
+		signal = &BehaviorSignal{SpeedMultiplier: 1.0}
+		run.BehaviorSignals[step] = signal
+	}
+	mutate(signal)
+	return nil
+}
+
+func (s *inMemoryRunStore) List() ([]*RunState, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*RunState, 0, len(s.runs))
+	for _, run := range s.runs {
+		out = append(out, run)
+	}
+	return out, nil
+}
+
+func (s *inMemoryRunStore) Delete(runID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.runs, runID)
+	delete(s.createdAt, runID)
+	return nil
+}
+
+func (s *inMemoryRunStore) Expire(olderThan time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-olderThan)
+	removed := 0
+	for runID, created := range s.createdAt {
+		if created.Before(cutoff) {
+			delete(s.runs, runID)
+			delete(s.createdAt, runID)
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteRunStore persists runs to a SQLite database on disk so traces and
+// behavior history survive restarts and can be resumed after a client
+// disconnect or reload. Trace and behavior signals are JSON-encoded blobs;
+// current_step is a plain column since it changes on every frame.
+type sqliteRunStore struct {
+	db *sql.DB
+}
+
+// newSQLiteRunStore opens (creating if necessary) a SQLite database at path
+// and starts a background sweeper that deletes runs older than ttl every
+// sweepInterval.
+func newSQLiteRunStore(path string, sweepInterval, ttl time.Duration) (*sqliteRunStore, error) {
+	// _pragma=busy_timeout applies to every connection the pool opens, not
+	// just the one that happens to run an Exec first, so a BEGIN IMMEDIATE
+	// (see UpdateBehavior) that loses the race for the write lock waits for
+	// the holder to finish instead of failing with SQLITE_BUSY right away.
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite run store: %w", err)
+	}
+
+	const schema = `
+	CREATE TABLE IF NOT EXISTS runs (
+		run_id           TEXT PRIMARY KEY,
+		trace            TEXT NOT NULL,
+		current_step     INTEGER NOT NULL DEFAULT 0,
+		behavior_signals TEXT NOT NULL,
+		created_at       DATETIME NOT NULL
+	);`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create sqlite schema: %w", err)
+	}
+
+	store := &sqliteRunStore{db: db}
+	go store.sweepLoop(sweepInterval, ttl)
+	return store, nil
+}
+
+func (s *sqliteRunStore) sweepLoop(interval, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		removed, err := s.Expire(ttl)
+		if err != nil {
+			fmt.Printf("Error expiring runs: %v\n", err)
+			continue
+		}
+		if removed > 0 {
+			fmt.Printf("Expired %d run(s) older than %s\n", removed, ttl)
+		}
+	}
+}
+
+func (s *sqliteRunStore) Create(run *RunState) error {
+	trace, err := json.Marshal(run.Trace)
+	if err != nil {
+		return err
+	}
+	signals, err := json.Marshal(run.BehaviorSignals)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO runs (run_id, trace, current_step, behavior_signals, created_at) VALUES (?, ?, ?, ?, ?)`,
+		run.RunID, trace, run.CurrentStep, signals, time.Now(),
+	)
+	return err
+}
+
+func (s *sqliteRunStore) Get(runID string) (*RunState, bool, error) {
+	row := s.db.QueryRow(`SELECT trace, current_step, behavior_signals FROM runs WHERE run_id = ?`, runID)
+
+	var trace, signals []byte
+	var currentStep int
+	if err := row.Scan(&trace, &currentStep, &signals); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	run := &RunState{RunID: runID, CurrentStep: currentStep}
+	if err := json.Unmarshal(trace, &run.Trace); err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(signals, &run.BehaviorSignals); err != nil {
+		return nil, false, err
+	}
+	return run, true, nil
+}
+
+func (s *sqliteRunStore) UpdateCurrentStep(runID string, step int) error {
+	res, err := s.db.Exec(`UPDATE runs SET current_step = ? WHERE run_id = ?`, step, runID)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(res, runID)
+}
+
+// UpdateBehavior reads, mutates and writes back behavior_signals inside a
+// single BEGIN IMMEDIATE transaction on one connection, so two concurrent
+// callers for the same run (e.g. chunk0-1's streamRun goroutine recording
+// speed/pause alongside a behavior.report call dispatched from the same
+// run's JSON-RPC reader) serialize instead of both reading the same blob
+// and one silently clobbering the other's write.
+func (s *sqliteRunStore) UpdateBehavior(runID string, step int, mutate func(signal *BehaviorSignal)) (err error) {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+			return
+		}
+		_, err = conn.ExecContext(ctx, "COMMIT")
+	}()
+
+	row := conn.QueryRowContext(ctx, `SELECT behavior_signals FROM runs WHERE run_id = ?`, runID)
+	var signals []byte
+	if err = row.Scan(&signals); err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("run not found: %s", runID)
+		}
+		return err
+	}
+
+	behaviorSignals := make(map[int]*BehaviorSignal)
+	if err = json.Unmarshal(signals, &behaviorSignals); err != nil {
+		return err
+	}
+
+	signal, ok := behaviorSignals[step]
+	if !ok {
+		signal = &BehaviorSignal{SpeedMultiplier: 1.0}
+		behaviorSignals[step] = signal
+	}
+	mutate(signal)
+
+	encoded, marshalErr := json.Marshal(behaviorSignals)
+	if marshalErr != nil {
+		err = marshalErr
+		return err
+	}
+
+	res, execErr := conn.ExecContext(ctx, `UPDATE runs SET behavior_signals = ? WHERE run_id = ?`, encoded, runID)
+	if execErr != nil {
+		err = execErr
+		return err
+	}
+	err = requireRowsAffected(res, runID)
+	return err
+}
+
+func (s *sqliteRunStore) List() ([]*RunState, error) {
+	rows, err := s.db.Query(`SELECT run_id, trace, current_step, behavior_signals FROM runs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*RunState
+	for rows.Next() {
+		var runID string
+		var trace, signals []byte
+		var currentStep int
+		if err := rows.Scan(&runID, &trace, &currentStep, &signals); err != nil {
+			return nil, err
+		}
+
+		run := &RunState{RunID: runID, CurrentStep: currentStep}
+		if err := json.Unmarshal(trace, &run.Trace); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(signals, &run.BehaviorSignals); err != nil {
+			return nil, err
+		}
+		out = append(out, run)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteRunStore) Delete(runID string) error {
+	_, err := s.db.Exec(`DELETE FROM runs WHERE run_id = ?`, runID)
+	return err
+}
+
+func (s *sqliteRunStore) Expire(olderThan time.Duration) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM runs WHERE created_at < ?`, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	affected, err := res.RowsAffected()
+	return int(affected), err
+}
+
+func requireRowsAffected(res sql.Result, runID string) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("run not found: %s", runID)
+	}
+	return nil
+}
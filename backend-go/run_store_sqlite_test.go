@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteRunStore(t *testing.T) *sqliteRunStore {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "runs.sqlite")
+	store, err := newSQLiteRunStore(dbPath, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("newSQLiteRunStore: %v", err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	return store
+}
+
+// TestSqliteUpdateBehaviorConcurrentIncrements exercises the exact race
+// chunk0-2's fix targets: many callers running a read-modify-write
+// UpdateBehavior for the same run and step at once. Every call should
+// succeed (busy_timeout lets a losing BEGIN IMMEDIATE wait instead of
+// failing with SQLITE_BUSY) and every increment should land (BEGIN
+// IMMEDIATE serializes the writers instead of letting one clobber another).
+func TestSqliteUpdateBehaviorConcurrentIncrements(t *testing.T) {
+	store := newTestSQLiteRunStore(t)
+
+	run := &RunState{
+		RunID:           "concurrent-run",
+		Trace:           []map[string]interface{}{{"step": 0}},
+		BehaviorSignals: make(map[int]*BehaviorSignal),
+	}
+	if err := store.Create(run); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	const goroutines = 50
+	var wg sync.WaitGroup
+	errs := make([]error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = store.UpdateBehavior(run.RunID, 0, func(signal *BehaviorSignal) {
+				signal.ReplayCount++
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("UpdateBehavior call %d failed: %v", i, err)
+		}
+	}
+
+	got, exists, err := store.Get(run.RunID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !exists {
+		t.Fatal("run disappeared")
+	}
+	if got.BehaviorSignals[0].ReplayCount != goroutines {
+		t.Fatalf("ReplayCount = %d, want %d (a lost update means the write lock isn't serializing)", got.BehaviorSignals[0].ReplayCount, goroutines)
+	}
+}
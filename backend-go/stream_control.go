@@ -0,0 +1,83 @@
+package main
+
+import "sync"
+
+// streamControl coordinates pause/resume/step/seek/speed/replay requests
+// coming from registered JSON-RPC method handlers (see rpc_methods.go) with
+// the frame-sending loop in streamRun. Every mutation closes wake so a
+// blocked streamRun reacts immediately instead of waiting out the current
+// frame delay.
+type streamControl struct {
+	mu              sync.Mutex
+	paused          bool
+	speedMultiplier float64
+	seekTo          *int
+	replay          bool
+	wake            chan struct{}
+}
+
+func newStreamControl(speedMultiplier float64) *streamControl {
+	if speedMultiplier <= 0 {
+		speedMultiplier = 1.0
+	}
+	return &streamControl{
+		speedMultiplier: speedMultiplier,
+		wake:            make(chan struct{}),
+	}
+}
+
+func (sc *streamControl) notifyLocked() {
+	close(sc.wake)
+	sc.wake = make(chan struct{})
+}
+
+func (sc *streamControl) setPaused(paused bool) {
+	sc.mu.Lock()
+	sc.paused = paused
+	sc.notifyLocked()
+	sc.mu.Unlock()
+}
+
+func (sc *streamControl) setSpeed(speed float64) {
+	if speed <= 0 {
+		return
+	}
+	sc.mu.Lock()
+	sc.speedMultiplier = speed
+	sc.notifyLocked()
+	sc.mu.Unlock()
+}
+
+func (sc *streamControl) seek(step int) {
+	sc.mu.Lock()
+	sc.seekTo = &step
+	sc.notifyLocked()
+	sc.mu.Unlock()
+}
+
+func (sc *streamControl) requestReplay() {
+	sc.mu.Lock()
+	sc.replay = true
+	sc.notifyLocked()
+	sc.mu.Unlock()
+}
+
+// snapshot returns the current control state along with the wake channel
+// that will be closed the next time any of that state changes.
+func (sc *streamControl) snapshot() (paused bool, speed float64, seekTo *int, replay bool, wake chan struct{}) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.paused, sc.speedMultiplier, sc.seekTo, sc.replay, sc.wake
+}
+
+func (sc *streamControl) clearSeek() {
+	sc.mu.Lock()
+	sc.seekTo = nil
+	sc.mu.Unlock()
+}
+
+func (sc *streamControl) clearReplay() {
+	sc.mu.Lock()
+	sc.replay = false
+	sc.mu.Unlock()
+}
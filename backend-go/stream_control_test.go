@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+func TestStreamControlSeekClampedByWaitForNextFrame(t *testing.T) {
+	control := newStreamControl(1.0)
+	control.seek(-5)
+
+	next := clampStep(-5, 9)
+	if next != 0 {
+		t.Fatalf("clampStep(-5, 9) = %d, want 0", next)
+	}
+
+	control = newStreamControl(1.0)
+	control.seek(100)
+	next = clampStep(100, 9)
+	if next != 9 {
+		t.Fatalf("clampStep(100, 9) = %d, want 9", next)
+	}
+}
+
+func TestStreamControlPauseResumeTogglesWake(t *testing.T) {
+	control := newStreamControl(1.0)
+
+	paused, _, _, _, wake := control.snapshot()
+	if paused {
+		t.Fatal("new streamControl should start unpaused")
+	}
+
+	control.setPaused(true)
+	select {
+	case <-wake:
+	default:
+		t.Fatal("setPaused should close the previous wake channel")
+	}
+
+	paused, _, _, _, _ = control.snapshot()
+	if !paused {
+		t.Fatal("expected paused after setPaused(true)")
+	}
+
+	control.setPaused(false)
+	paused, _, _, _, _ = control.snapshot()
+	if paused {
+		t.Fatal("expected unpaused after setPaused(false)")
+	}
+}
+
+func TestStreamControlSetSpeedIgnoresNonPositive(t *testing.T) {
+	control := newStreamControl(2.0)
+
+	control.setSpeed(0)
+	_, speed, _, _, _ := control.snapshot()
+	if speed != 2.0 {
+		t.Fatalf("setSpeed(0) should be ignored, got speed %v", speed)
+	}
+
+	control.setSpeed(-1)
+	_, speed, _, _, _ = control.snapshot()
+	if speed != 2.0 {
+		t.Fatalf("setSpeed(-1) should be ignored, got speed %v", speed)
+	}
+
+	control.setSpeed(3.5)
+	_, speed, _, _, _ = control.snapshot()
+	if speed != 3.5 {
+		t.Fatalf("setSpeed(3.5) not applied, got speed %v", speed)
+	}
+}
+
+func TestStreamControlReplayClearsAfterConsumption(t *testing.T) {
+	control := newStreamControl(1.0)
+	control.requestReplay()
+
+	_, _, _, replay, _ := control.snapshot()
+	if !replay {
+		t.Fatal("expected replay flag set after requestReplay")
+	}
+
+	control.clearReplay()
+	_, _, _, replay, _ = control.snapshot()
+	if replay {
+		t.Fatal("expected replay flag cleared after clearReplay")
+	}
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -30,14 +30,13 @@ type BehaviorSignal struct {
 	ScrollDepth      *int    `json:"scrollDepth,omitempty"`
 }
 
-// In-memory storage
-var (
-	runs   = make(map[string]*RunState)
-	runsMu sync.RWMutex
-)
+// runStore persists run state; see run_store.go for the interface and its
+// in-memory/SQLite implementations. main() may swap this for a
+// newSQLiteRunStore before serving any requests.
+var runStore RunStore = newInMemoryRunStore()
 
 // Call Python /execute endpoint
-func callPythonExecute(algorithmID string, array []int) ([]map[string]interface{}, error) {
+func callPythonExecute(ctx context.Context, algorithmID string, array []int) ([]map[string]interface{}, error) {
 	requestBody := map[string]interface{}{
 		"algorithmId": algorithmID,
 		"array":       array,
@@ -48,7 +47,13 @@ func callPythonExecute(algorithmID string, array []int) ([]map[string]interface{
 		return nil, err
 	}
 
-	resp, err := http.Post(pythonBaseURL+"/execute", "application/json", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pythonBaseURL+"/execute", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to call Python backend: %w", err)
 	}
@@ -70,7 +75,7 @@ func callPythonExecute(algorithmID string, array []int) ([]map[string]interface{
 }
 
 // Call Python /explain-step endpoint
-func callPythonExplain(frame map[string]interface{}, userBehavior map[string]interface{}) (map[string]interface{}, error) {
+func callPythonExplain(ctx context.Context, frame map[string]interface{}, userBehavior map[string]interface{}) (map[string]interface{}, error) {
 	requestBody := map[string]interface{}{
 		"frame":        frame,
 		"userBehavior": userBehavior,
@@ -81,7 +86,13 @@ func callPythonExplain(frame map[string]interface{}, userBehavior map[string]int
 		return nil, err
 	}
 
-	resp, err := http.Post(pythonBaseURL+"/explain-step", "application/json", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pythonBaseURL+"/explain-step", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to call Python backend: %w", err)
 	}
@@ -102,9 +113,10 @@ func callPythonExplain(frame map[string]interface{}, userBehavior map[string]int
 
 // Get or create behavior signal for a step
 func getBehaviorSignal(runID string, stepIndex int) map[string]interface{} {
-	runsMu.RLock()
-	run, exists := runs[runID]
-	runsMu.RUnlock()
+	run, exists, err := runStore.Get(runID)
+	if err != nil {
+		fmt.Printf("Error loading run %s: %v\n", runID, err)
+	}
 
 	if !exists {
 		return map[string]interface{}{
@@ -131,38 +143,133 @@ func getBehaviorSignal(runID string, stepIndex int) map[string]interface{} {
 	}
 }
 
-// Stream trace frames via WebSocket
-func streamRun(runID string, conn *websocketConnection, speedMultiplier float64) error {
-	runsMu.RLock()
-	run, exists := runs[runID]
-	runsMu.RUnlock()
+// currentRunStep reports the step a run's stream loop is currently on, used
+// by the control-channel reader to resolve a relative STEP request.
+func currentRunStep(runID string) int {
+	run, exists, err := runStore.Get(runID)
+	if err != nil || !exists {
+		return 0
+	}
+	return run.CurrentStep
+}
+
+// recordReplay, recordPauseDuration and recordSpeed fold control-channel
+// activity into the step's BehaviorSignal, through runStore, so the next
+// callPythonExplain call sees it.
+func recordReplay(runID string, step int) error {
+	return runStore.UpdateBehavior(runID, step, func(signal *BehaviorSignal) {
+		signal.ReplayCount++
+	})
+}
+
+func recordPauseDuration(runID string, step int, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	return runStore.UpdateBehavior(runID, step, func(signal *BehaviorSignal) {
+		signal.PauseDuration += d.Seconds()
+	})
+}
+
+func recordSpeed(runID string, step int, speed float64) error {
+	return runStore.UpdateBehavior(runID, step, func(signal *BehaviorSignal) {
+		signal.SpeedMultiplier = speed
+	})
+}
+
+// recordHoverAndScroll folds a behavior.report call into the step's
+// BehaviorSignal, leaving fields the client didn't report untouched.
+func recordHoverAndScroll(runID string, params behaviorReportParams) error {
+	return runStore.UpdateBehavior(runID, params.Step, func(signal *BehaviorSignal) {
+		if params.HoverIndex != nil {
+			signal.HoverIndex = params.HoverIndex
+		}
+		if params.ScrollDepth != nil {
+			signal.ScrollDepth = params.ScrollDepth
+		}
+	})
+}
+
+// prefetchExplanations batches explain requests for frame `from` and up to
+// lookaheadFrames beyond it that aren't already cached, via the persistent
+// Python explain stream, so streamRun rarely blocks on a per-frame call.
+func prefetchExplanations(ctx context.Context, runID string, run *RunState, cache *explanationCache, from int, speed float64) error {
+	upper := from + lookaheadFrames + 1
+	if upper > len(run.Trace) {
+		upper = len(run.Trace)
+	}
 
+	var pending []explainFrameRequest
+	for step := from; step < upper; step++ {
+		if cache.has(step) {
+			continue
+		}
+		userBehavior := getBehaviorSignal(runID, step)
+		userBehavior["speedMultiplier"] = speed
+		pending = append(pending, explainFrameRequest{
+			Step:         step,
+			Frame:        run.Trace[step],
+			UserBehavior: userBehavior,
+		})
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	explanations, err := defaultPythonClient.ExplainBatch(ctx, runID, pending)
+	if err != nil {
+		return err
+	}
+	for step, explanation := range explanations {
+		cache.put(step, explanation)
+	}
+	return nil
+}
+
+// Stream trace frames over the JSON-RPC dispatcher as trace.frame/
+// trace.explanation/trace.end notifications, reacting to pause/resume/
+// step/seek/speed/replay requests delivered through control. ctx is
+// canceled on client disconnect or server shutdown (see Dispatcher.Context),
+// at which point streamRun stops at the next frame boundary instead of
+// running the trace to completion.
+func streamRun(ctx context.Context, runID string, dispatcher *Dispatcher, control *streamControl) error {
+	run, exists, err := runStore.Get(runID)
+	if err != nil {
+		return fmt.Errorf("failed to load run: %w", err)
+	}
 	if !exists {
 		return fmt.Errorf("run not found: %s", runID)
 	}
 
-	// Calculate frame delay based on speed multiplier
-	baseDelay := 1000.0 // milliseconds
-	frameDelay := time.Duration(baseDelay/speedMultiplier) * time.Millisecond
+	cache := newExplanationCache()
+
+	i := 0
+	for i < len(run.Trace) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-	for i, frame := range run.Trace {
-		// Send TRACE message
-		traceMsg := map[string]interface{}{
-			"type": "TRACE",
-			"data": frame,
+		frame := run.Trace[i]
+		if err := runStore.UpdateCurrentStep(runID, i); err != nil {
+			return fmt.Errorf("failed to update current step: %w", err)
 		}
-		if err := conn.WriteJSON(traceMsg); err != nil {
+
+		if err := dispatcher.Notify("trace.frame", traceFrameParams{Frame: frame}); err != nil {
 			return fmt.Errorf("failed to send trace: %w", err)
 		}
 
 		// Get behavior signal
-		userBehavior := getBehaviorSignal(runID, i)
-		userBehavior["speedMultiplier"] = speedMultiplier
+		_, speed, _, _, _ := control.snapshot()
 
-		// Call AI explainer
-		explanation, err := callPythonExplain(frame, userBehavior)
-		if err != nil {
-			fmt.Printf("Error getting explanation: %v\n", err)
+		// Pre-fetch this frame's explanation plus a few upcoming ones in a
+		// single batched call, so later steps are usually already cached.
+		if err := prefetchExplanations(ctx, runID, run, cache, i, speed); err != nil {
+			fmt.Printf("Error prefetching explanations: %v\n", err)
+		}
+
+		explanation, ok := cache.take(i)
+		if !ok {
+			fmt.Printf("Error getting explanation: explanation for step %d was not prefetched\n", i)
 			// Send fallback explanation
 			explanation = map[string]interface{}{
 				"mode":                "conceptual",
@@ -173,50 +280,115 @@ func streamRun(runID string, conn *websocketConnection, speedMultiplier float64)
 			}
 		}
 
-		// Send EXPLANATION message
-		explainMsg := map[string]interface{}{
-			"type": "EXPLANATION",
-			"data": explanation,
-		}
-		if err := conn.WriteJSON(explainMsg); err != nil {
+		if err := dispatcher.Notify("trace.explanation", traceExplanationParams{Explanation: explanation}); err != nil {
 			return fmt.Errorf("failed to send explanation: %w", err)
 		}
 
-		// Wait before next frame
-		time.Sleep(frameDelay)
+		next, err := waitForNextFrame(ctx, runID, i, len(run.Trace), control)
+		if err != nil {
+			return err
+		}
+		i = next
 	}
 
-	// Send END message
-	endMsg := map[string]interface{}{
-		"type": "END",
-		"data": map[string]interface{}{
-			"message": "Visualization complete",
-		},
+	return dispatcher.Notify("trace.end", traceEndParams{Message: "Visualization complete"})
+}
+
+// waitForNextFrame blocks until the current frame's delay elapses, ctx is
+// canceled, or a control message changes what should happen next, returning
+// the index of the frame streamRun should send next. maxStep is the trace
+// length, used to clamp a client-supplied SEEK/run.seek step into
+// [0, maxStep] before it's ever used to index the trace.
+func waitForNextFrame(ctx context.Context, runID string, current int, maxStep int, control *streamControl) (int, error) {
+	const baseDelay = 1000.0 // milliseconds
+
+	var pauseStart time.Time
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		paused, speed, seekTo, replay, wake := control.snapshot()
+
+		if seekTo != nil {
+			control.clearSeek()
+			return clampStep(*seekTo, maxStep), nil
+		}
+		if replay {
+			control.clearReplay()
+			if err := recordReplay(runID, current); err != nil {
+				fmt.Printf("Error recording replay: %v\n", err)
+			}
+			return current, nil
+		}
+		if paused {
+			if pauseStart.IsZero() {
+				pauseStart = time.Now()
+			}
+			select {
+			case <-wake:
+				continue
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+		if !pauseStart.IsZero() {
+			if err := recordPauseDuration(runID, current, time.Since(pauseStart)); err != nil {
+				fmt.Printf("Error recording pause duration: %v\n", err)
+			}
+			pauseStart = time.Time{}
+		}
+
+		if err := recordSpeed(runID, current, speed); err != nil {
+			fmt.Printf("Error recording speed: %v\n", err)
+		}
+		timer := time.NewTimer(time.Duration(baseDelay/speed) * time.Millisecond)
+		select {
+		case <-timer.C:
+			return current + 1, nil
+		case <-wake:
+			timer.Stop()
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// clampStep confines an untrusted step index (SEEK/run.seek comes straight
+// from the client) to [0, maxStep], so a negative or past-the-end value
+// can't reach run.Trace[i] as a raw slice index.
+func clampStep(step, maxStep int) int {
+	if step < 0 {
+		return 0
 	}
-	return conn.WriteJSON(endMsg)
+	if step > maxStep {
+		return maxStep
+	}
+	return step
 }
 
 // Create new run
-func createRun(algorithmID string, array []int) (*RunState, error) {
+func createRun(ctx context.Context, algorithmID string, array []int) (*RunState, error) {
 	// Call Python to get trace
-	trace, err := callPythonExecute(algorithmID, array)
+	trace, err := callPythonExecute(ctx, algorithmID, array)
 	if err != nil {
 		return nil, err
 	}
 
 	// Create run state
-	runID := uuid.New().String()
 	run := &RunState{
-		RunID:           runID,
+		RunID:           uuid.New().String(),
 		Trace:           trace,
 		CurrentStep:     0,
 		BehaviorSignals: make(map[int]*BehaviorSignal),
 	}
 
 	// Store run
-	runsMu.Lock()
-	runs[runID] = run
-	runsMu.Unlock()
+	if err := runStore.Create(run); err != nil {
+		return nil, fmt.Errorf("failed to store run: %w", err)
+	}
 
 	return run, nil
 }
@@ -0,0 +1,46 @@
+package main
+
+import "sync"
+
+// maxWSConnsPerIP caps how many concurrent WebSocket connections a single
+// IP may hold open, so one client can't exhaust server resources by
+// opening run after run.
+const maxWSConnsPerIP = 5
+
+// wsConnLimiter tracks concurrent (not rate-over-time, unlike fiber's
+// built-in limiter middleware) WebSocket connections per IP.
+type wsConnLimiter struct {
+	mu       sync.Mutex
+	perIP    map[string]int
+	maxPerIP int
+}
+
+func newWSConnLimiter(maxPerIP int) *wsConnLimiter {
+	return &wsConnLimiter{perIP: make(map[string]int), maxPerIP: maxPerIP}
+}
+
+// acquire reserves a connection slot for ip, returning false if it's
+// already at maxPerIP.
+func (l *wsConnLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+// release frees the slot reserved by a matching acquire. Callers must call
+// it exactly once per successful acquire, typically via defer once the
+// connection is established.
+func (l *wsConnLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+var wsLimiter = newWSConnLimiter(maxWSConnsPerIP)